@@ -0,0 +1,268 @@
+package nspawn
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/types"
+	"github.com/coreos/go-systemd/machine1"
+	hclog "github.com/hashicorp/go-hclog"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// AutoUpdateConfig configures a background reconciler that watches a task's
+// source image for new digests and performs an in-place replacement when
+// one shows up, the same workflow as `podman auto-update`.
+type AutoUpdateConfig struct {
+	// Policy is "registry" (re-resolve the manifest digest against the
+	// container registry the image was pulled from; importd tar/raw URLs are
+	// not re-resolved) or "local" (only pick up images already pulled into machinectl
+	// storage under the same name).
+	Policy string `codec:"policy"`
+	// Interval between reconcile passes.
+	Interval time.Duration `codec:"interval"`
+	// Rollback restarts the previous image when the new one fails its
+	// health/liveness check after restart.
+	Rollback bool `codec:"rollback"`
+}
+
+func (c *AutoUpdateConfig) Validate() error {
+	switch c.Policy {
+	case "registry", "local":
+	default:
+		return fmt.Errorf("invalid parameter for auto_update.policy")
+	}
+	if c.Interval <= 0 {
+		return fmt.Errorf("auto_update.interval must be positive")
+	}
+	return nil
+}
+
+// autoUpdater tracks the reconciliation state for a single task and is kept
+// on the taskHandle for the task's lifetime.
+type autoUpdater struct {
+	cfg    *AutoUpdateConfig
+	logger hclog.Logger
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+
+	// digestMu guards currentDigest/pendingDigest: run() mutates them from
+	// its own goroutine while driverAttributes() is read from TaskStatus(),
+	// which runs on whatever goroutine calls it.
+	digestMu      sync.Mutex
+	currentDigest string
+	pendingDigest string
+}
+
+// newAutoUpdater records the digest a task started with so the first
+// reconcile pass has something to diff against.
+func newAutoUpdater(cfg *AutoUpdateConfig, startDigest string, logger hclog.Logger) *autoUpdater {
+	return &autoUpdater{
+		cfg:           cfg,
+		logger:        logger,
+		stopCh:        make(chan struct{}),
+		currentDigest: startDigest,
+	}
+}
+
+// run polls resolveDigest on the configured interval and invokes onUpdate
+// whenever it returns a digest that differs from the one recorded at the
+// last successful update. onUpdate is responsible for the actual
+// stop/pull/rename/restart dance and returns the digest that ended up
+// running (which may be the rolled-back original on failure).
+func (u *autoUpdater) run(resolveDigest func() (string, error), onUpdate func(newDigest string) (string, error)) {
+	ticker := time.NewTicker(u.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.stopCh:
+			return
+		case <-ticker.C:
+			next, err := resolveDigest()
+			if err != nil {
+				u.logger.Warn("auto-update: failed to resolve image digest", "error", err)
+				continue
+			}
+
+			u.digestMu.Lock()
+			current := u.currentDigest
+			u.digestMu.Unlock()
+			if next == current {
+				continue
+			}
+
+			u.logger.Info("auto-update: new image digest available", "current", current, "pending", next)
+			u.digestMu.Lock()
+			u.pendingDigest = next
+			u.digestMu.Unlock()
+
+			ran, err := onUpdate(next)
+
+			u.digestMu.Lock()
+			if err != nil {
+				u.pendingDigest = ""
+				u.digestMu.Unlock()
+				u.logger.Error("auto-update: failed to roll out new image", "error", err)
+				continue
+			}
+			u.currentDigest = ran
+			u.pendingDigest = ""
+			u.digestMu.Unlock()
+		}
+	}
+}
+
+func (u *autoUpdater) stop() {
+	u.stopOnce.Do(func() { close(u.stopCh) })
+}
+
+// driverAttributes surfaces the current/pending digests for TaskStatus.
+func (u *autoUpdater) driverAttributes() map[string]string {
+	if u == nil {
+		return nil
+	}
+
+	u.digestMu.Lock()
+	defer u.digestMu.Unlock()
+
+	attrs := map[string]string{
+		"auto_update.current_digest": u.currentDigest,
+	}
+	if u.pendingDigest != "" {
+		attrs["auto_update.pending_digest"] = u.pendingDigest
+	}
+	return attrs
+}
+
+// ResolveImageDigest computes the digest that should be compared against a
+// task's recorded digest for the given auto_update policy: "registry"
+// re-resolves the manifest digest from the source reference, while "local"
+// hashes the name, size and modification time of the entry under name in
+// machinectl storage (not its file contents), so a re-pull of the same tag
+// into that name, which recreates the directory, is still detected.
+func ResolveImageDigest(ref, name, policy string, auth *RegistryAuth) (string, error) {
+	switch policy {
+	case "registry":
+		srcRef, err := resolveSourceReference(ref)
+		if err != nil {
+			return "", err
+		}
+		sysCtx := &types.SystemContext{}
+		if auth != nil && auth.Username != "" {
+			sysCtx.DockerAuthConfig = &types.DockerAuthConfig{Username: auth.Username, Password: auth.Password}
+		}
+		d, err := docker.GetDigest(context.Background(), sysCtx, srcRef)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve registry digest for %q: %v", ref, err)
+		}
+		return d.String(), nil
+	case "local":
+		info, err := os.Stat(filepath.Join(machinesDir, name))
+		if err != nil {
+			return "", err
+		}
+		return digest.FromString(fmt.Sprintf("%s-%d-%d", name, info.Size(), info.ModTime().UnixNano())).String(), nil
+	default:
+		return "", fmt.Errorf("invalid auto_update.policy %q", policy)
+	}
+}
+
+// startAutoUpdate builds an autoUpdater for a just-started task and kicks
+// off its reconcile loop. startDigest is the digest the task was actually
+// launched with, so the first pass only fires once a genuinely new image
+// shows up.
+func startAutoUpdate(h *taskHandle, mc *MachineConfig, startDigest string) *autoUpdater {
+	u := newAutoUpdater(mc.AutoUpdate, startDigest, h.logger)
+
+	resolveDigest := func() (string, error) {
+		return ResolveImageDigest(mc.ImageDownloadRef(), mc.Machine, mc.AutoUpdate.Policy, mc.imageDownloadAuth())
+	}
+
+	onUpdate := func(newDigest string) (string, error) {
+		return rolloutImageUpdate(h, mc, newDigest)
+	}
+
+	go u.run(resolveDigest, onUpdate)
+	return u
+}
+
+// rolloutImageUpdate pulls the new image under a versioned name, swaps it
+// in for the running image, and stops the current scope so Nomad's task
+// restart policy relaunches StartTask against the now-current (newly
+// pulled) image. If the task hasn't reached TaskStateRunning again within
+// a short grace period, and Rollback is set, the previous image is swapped
+// back in before the task is restarted again.
+func rolloutImageUpdate(h *taskHandle, mc *MachineConfig, newDigest string) (string, error) {
+	currentPath := filepath.Join(machinesDir, mc.Machine)
+	previousPath := currentPath + "@previous"
+	pendingPath := currentPath + "@pending"
+
+	auth := mc.imageDownloadAuth()
+	if _, _, err := PullOCIImage(mc.ImageDownloadRef(), filepath.Base(pendingPath), auth, "checksum", nil, true, nil, h.logger); err != nil {
+		return "", fmt.Errorf("failed to pull updated image: %v", err)
+	}
+
+	os.RemoveAll(previousPath)
+	if err := os.Rename(currentPath, previousPath); err != nil {
+		return "", fmt.Errorf("failed to archive current image: %v", err)
+	}
+	if err := os.Rename(pendingPath, currentPath); err != nil {
+		os.Rename(previousPath, currentPath)
+		return "", fmt.Errorf("failed to promote updated image: %v", err)
+	}
+
+	h.logger.Info("auto-update: rolling out new image, restarting task", "machine", mc.Machine, "digest", newDigest)
+	if err := terminateMachine(mc.Machine); err != nil {
+		h.logger.Warn("auto-update: failed to terminate running machine for restart", "error", err)
+	}
+
+	if mc.AutoUpdate.Rollback && !waitForRunning(h.taskConfig.ID, 30*time.Second) {
+		h.logger.Warn("auto-update: task did not come back healthy, rolling back", "machine", mc.Machine)
+		os.RemoveAll(currentPath)
+		if err := os.Rename(previousPath, currentPath); err != nil {
+			return "", fmt.Errorf("failed to roll back image: %v", err)
+		}
+		terminateMachine(mc.Machine)
+		return ResolveImageDigest(mc.ImageDownloadRef(), mc.Machine, mc.AutoUpdate.Policy, auth)
+	}
+
+	return newDigest, nil
+}
+
+func terminateMachine(name string) error {
+	c, err := machine1.New()
+	if err != nil {
+		return err
+	}
+	return c.TerminateMachine(name)
+}
+
+// waitForRunning polls for up to timeout, giving Nomad's task restart policy
+// time to relaunch StartTask against the newly promoted image before we
+// decide the rollout failed. terminateMachine, above, kills the machine
+// backing the taskHandle that's running this reconciler, so that handle's
+// own IsRunning will never flip back to true - it's the new taskHandle
+// StartTask creates for the replacement task that matters here, so each
+// poll looks it up fresh by task ID instead of closing over the old one.
+func waitForRunning(taskID string, timeout time.Duration) bool {
+	running := func() bool {
+		h := lookupTaskHandle(taskID)
+		return h != nil && h.IsRunning()
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if running() {
+			return true
+		}
+		time.Sleep(time.Second)
+	}
+	return running()
+}
@@ -0,0 +1,259 @@
+package nspawn
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// BlobCache wraps an image source so every blob/manifest it reads is first
+// checked against (and on miss, written to) a shared on-disk cache keyed by
+// digest. This lets many tasks, and repeated allocations across driver
+// restarts, share layers instead of re-pulling them on every OCI/docker
+// `DownloadImage` call. Only the OCI/docker pull path reads through the
+// cache; importd tar/raw downloads do not use it.
+//
+// Modeled on buildah's pkg/blobcache: a thin types.ImageSource wrapper plus
+// an LRU-with-cap GC policy run out of band.
+type BlobCache struct {
+	dir       string
+	maxSizeMB int64
+	logger    hclog.Logger
+
+	// keyMu guards keyLocks itself; the per-digest mutexes it hands out are
+	// what actually serialize access to a given cache entry, so concurrent
+	// pulls of different digests (the common case across tasks/images)
+	// don't block each other.
+	keyMu    sync.Mutex
+	keyLocks map[string]*sync.Mutex
+
+	// dirMu guards whole-directory operations (GC/Prune) that enumerate
+	// every entry at once.
+	dirMu sync.Mutex
+}
+
+// NewBlobCache returns a BlobCache rooted at dir (typically under the
+// plugin's data dir, e.g. <data-dir>/images/blobs). maxSizeMB <= 0 disables
+// the LRU size cap; entries are only removed via explicit prune calls.
+func NewBlobCache(dir string, maxSizeMB int64, logger hclog.Logger) (*BlobCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create blob cache dir: %v", err)
+	}
+	return &BlobCache{dir: dir, maxSizeMB: maxSizeMB, logger: logger}, nil
+}
+
+func (b *BlobCache) path(d string) string {
+	sum := sha256.Sum256([]byte(d))
+	return filepath.Join(b.dir, hex.EncodeToString(sum[:]))
+}
+
+// lockFor returns the mutex dedicated to digest d, creating it on first use.
+func (b *BlobCache) lockFor(d string) *sync.Mutex {
+	b.keyMu.Lock()
+	defer b.keyMu.Unlock()
+
+	if b.keyLocks == nil {
+		b.keyLocks = make(map[string]*sync.Mutex)
+	}
+	l, ok := b.keyLocks[d]
+	if !ok {
+		l = &sync.Mutex{}
+		b.keyLocks[d] = l
+	}
+	return l
+}
+
+// GetOrFetch returns the cached bytes for digest d, calling fetch and
+// persisting its result when the entry is missing. fetch is only invoked on
+// a cache miss, so callers can pass an expensive network read. Only fetches
+// of the same digest serialize against each other; unrelated digests proceed
+// concurrently.
+func (b *BlobCache) GetOrFetch(d string, fetch func() (io.ReadCloser, int64, error)) (io.ReadCloser, error) {
+	lock := b.lockFor(d)
+	lock.Lock()
+	defer lock.Unlock()
+
+	path := b.path(d)
+	if f, err := os.Open(path); err == nil {
+		if err := b.verifyIntegrity(path, d); err != nil {
+			f.Close()
+			os.Remove(path)
+		} else {
+			os.Chtimes(path, time.Now(), time.Now())
+			return f, nil
+		}
+	}
+
+	rc, _, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(out, rc); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	out.Close()
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+// verifyIntegrity re-hashes a cached blob on read and compares it against
+// the digest it's keyed by, guarding against silent on-disk corruption
+// (the fscrypt-style integrity check requested alongside the cache).
+func (b *BlobCache) verifyIntegrity(path, d string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := "sha256:" + hex.EncodeToString(h.Sum(nil)); sum != d {
+		return fmt.Errorf("blob cache entry %s failed integrity check", d)
+	}
+	return nil
+}
+
+type cacheEntry struct {
+	path    string
+	size    int64
+	accessT time.Time
+}
+
+// GC enforces the configured size cap by evicting least-recently-used
+// entries until the cache is back under the limit. A no-op when no cap was
+// configured.
+func (b *BlobCache) GC() error {
+	if b.maxSizeMB <= 0 {
+		return nil
+	}
+
+	b.dirMu.Lock()
+	defer b.dirMu.Unlock()
+
+	entries, total, err := b.listEntries()
+	if err != nil {
+		return err
+	}
+
+	limit := b.maxSizeMB * 1024 * 1024
+	if total <= limit {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].accessT.Before(entries[j].accessT)
+	})
+
+	for _, e := range entries {
+		if total <= limit {
+			break
+		}
+		if err := os.Remove(e.path); err != nil {
+			continue
+		}
+		total -= e.size
+		b.logger.Debug("evicted blob cache entry", "path", e.path)
+	}
+	return nil
+}
+
+// Prune removes cache entries not accessed since before, or a single entry
+// matching digest when digest is non-empty.
+func (b *BlobCache) Prune(digest string, before time.Time) error {
+	b.dirMu.Lock()
+	defer b.dirMu.Unlock()
+
+	if digest != "" {
+		return os.Remove(b.path(digest))
+	}
+
+	entries, _, err := b.listEntries()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.accessT.Before(before) {
+			os.Remove(e.path)
+		}
+	}
+	return nil
+}
+
+func (b *BlobCache) listEntries() ([]cacheEntry, int64, error) {
+	var entries []cacheEntry
+	var total int64
+
+	err := filepath.Walk(b.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		entries = append(entries, cacheEntry{path: path, size: info.Size(), accessT: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	return entries, total, err
+}
+
+// cachedImageSource wraps a types.ImageSource so GetBlob reads go through
+// the shared BlobCache before falling back to the network.
+type cachedImageSource struct {
+	types.ImageSource
+	cache *BlobCache
+}
+
+// WithBlobCache wraps src so its GetBlob calls are served from cache, the
+// same shape copy.Image expects of any types.ImageSource.
+func WithBlobCache(src types.ImageSource, cache *BlobCache) types.ImageSource {
+	return &cachedImageSource{ImageSource: src, cache: cache}
+}
+
+func (s *cachedImageSource) GetBlob(ctx context.Context, bi types.BlobInfo, bc types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	rc, err := s.cache.GetOrFetch(bi.Digest.String(), func() (io.ReadCloser, int64, error) {
+		return s.ImageSource.GetBlob(ctx, bi, bc)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return rc, bi.Size, nil
+}
+
+// cachedImageReference wraps a types.ImageReference so NewImageSource
+// returns a blob-cache-backed source, letting PullOCIImage opt in to the
+// shared cache without every caller threading a BlobCache through.
+type cachedImageReference struct {
+	types.ImageReference
+	cache *BlobCache
+}
+
+func (r cachedImageReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	src, err := r.ImageReference.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return WithBlobCache(src, r.cache), nil
+}
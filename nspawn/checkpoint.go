@@ -0,0 +1,345 @@
+package nspawn
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	systemdDbus "github.com/coreos/go-systemd/dbus"
+	"github.com/godbus/dbus"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// CheckpointOpts configures a single CRIU dump of a running task.
+type CheckpointOpts struct {
+	// LeaveRunning keeps the container alive after the dump (a "live"
+	// checkpoint), instead of the default stop-the-world dump.
+	LeaveRunning bool
+	// TCPEstablished allows dumping/restoring sockets with open TCP
+	// connections, required for most long-lived network services.
+	TCPEstablished bool
+}
+
+// RestoreOpts configures restoring a task from a checkpoint directory
+// produced by Checkpoint.
+type RestoreOpts struct {
+	TCPEstablished bool
+}
+
+// checkpointMetadata is the small sidecar JSON written next to the CRIU
+// image directory, modeled on checkpointctl's config.dump/spec.dump pair:
+// enough to recreate the scope unit and re-bind the same mounts/netns
+// without re-deriving them from the original MachineConfig.
+type checkpointMetadata struct {
+	Version        int               `json:"version"`
+	Image          string            `json:"image"`
+	UnitName       string            `json:"unit_name"`
+	Mounts         map[string]string `json:"mounts"`
+	NetNSPath      string            `json:"netns_path"`
+	CNIConfig      *CNIConfig        `json:"cni_config,omitempty"`
+	CheckpointedAt time.Time         `json:"checkpointed_at"`
+}
+
+const checkpointMetadataVersion = 1
+
+// Checkpoint dumps the task's container to checkpointDir via CRIU, writing
+// config.dump metadata alongside the CRIU image files (no spec.dump is
+// written; config.dump holds all of checkpointMetadata) so Restore
+// can recreate the scope unit and mounts without access to the original
+// task config.
+func (h *taskHandle) Checkpoint(checkpointDir string, opts CheckpointOpts) error {
+	h.stateLock.RLock()
+	taskID := h.taskConfig.ID
+	mc := h.machineConfig
+	cniCfg := h.cniConfig
+	var netnsPath string
+	if h.cniResult != nil {
+		netnsPath = h.cniResult.NetNSPath
+	}
+	h.stateLock.RUnlock()
+
+	props, err := DescribeMachine(h.machineName, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to describe machine for checkpoint: %v", err)
+	}
+
+	if err := os.MkdirAll(checkpointDir, 0700); err != nil {
+		return err
+	}
+
+	args := []string{
+		"dump",
+		"--tree", strconv.FormatUint(uint64(props.Leader), 10),
+		"--images-dir", checkpointDir,
+		"--shell-job",
+	}
+	if opts.LeaveRunning {
+		args = append(args, "--leave-running")
+	}
+	if opts.TCPEstablished {
+		args = append(args, "--tcp-established")
+	}
+
+	h.logger.Info("checkpointing task", "task_id", taskID, "pid", props.Leader, "dir", checkpointDir)
+	cmd := exec.Command("criu", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("criu dump failed: %v: %s", err, out)
+	}
+
+	meta := checkpointMetadata{
+		Version:        checkpointMetadataVersion,
+		Image:          mc.Image,
+		UnitName:       props.Unit,
+		Mounts:         map[string]string(mc.Bind),
+		NetNSPath:      netnsPath,
+		CNIConfig:      cniCfg,
+		CheckpointedAt: time.Now(),
+	}
+	metaBytes, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(checkpointDir, "config.dump"), metaBytes, 0600); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Restore recreates the task's scope unit via the existing systemdDbus path,
+// re-runs CRIU restore with the same bind mounts re-bound through
+// --ext-mount-map, and registers the restored leader PID with a transient
+// scope so DescribeMachine/TaskStatus/cgroup accounting keep working the
+// same as for any other task. It returns the restored leader's PID alongside
+// the metadata: --restore-detached re-parents that process to init rather
+// than making it a child of this driver, so it can't be waited on through
+// exec.Cmd/executor.Executor the way a freshly-launched task can. The caller
+// is expected to use the pid with resumeAfterRestore rather than re-entering
+// h.run(), which waits on the pre-checkpoint (and by now dead) executor.
+func Restore(checkpointDir string, machineName string, opts RestoreOpts, logger hclog.Logger) (*checkpointMetadata, uint32, error) {
+	metaBytes, err := os.ReadFile(filepath.Join(checkpointDir, "config.dump"))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read checkpoint metadata: %v", err)
+	}
+	var meta checkpointMetadata
+	if err := json.Unmarshal(metaBytes, &meta); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse checkpoint metadata: %v", err)
+	}
+
+	netnsPath := meta.NetNSPath
+	if meta.CNIConfig != nil {
+		result, err := SetupCNINetwork(machineName, meta.CNIConfig, logger)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to recreate cni network for restore: %v", err)
+		}
+		netnsPath = result.NetNSPath
+	}
+
+	pidFile := filepath.Join(checkpointDir, "restore.pid")
+	args := []string{
+		"restore",
+		"--images-dir", checkpointDir,
+		"--shell-job",
+		"--restore-detached",
+		"--pidfile", pidFile,
+	}
+	if opts.TCPEstablished {
+		args = append(args, "--tcp-established")
+	}
+	if netnsPath != "" {
+		args = append(args, "--netns", netnsPath)
+	}
+	for host, container := range meta.Mounts {
+		args = append(args, "--ext-mount-map", host+":"+container)
+	}
+
+	logger.Info("restoring task from checkpoint", "machine", machineName, "dir", checkpointDir)
+	cmd := exec.Command("criu", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, 0, fmt.Errorf("criu restore failed: %v: %s", err, out)
+	}
+
+	pid, err := readPidFile(pidFile)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read restored leader pid: %v", err)
+	}
+
+	unitName := meta.UnitName
+	if unitName == "" {
+		unitName = "nspawn-" + machineName + ".scope"
+	}
+	if err := recreateScopeUnit(unitName, pid); err != nil {
+		return nil, 0, fmt.Errorf("failed to recreate scope unit for restored task: %v", err)
+	}
+
+	return &meta, pid, nil
+}
+
+func readPidFile(path string) (uint32, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(pid), nil
+}
+
+// recreateScopeUnit registers pid with a transient systemd scope of the
+// given name via the same dbus connection path systemdVersion() uses
+// elsewhere in this package, the way "systemd-run --scope" would.
+func recreateScopeUnit(unitName string, pid uint32) error {
+	conn, err := systemdDbus.NewSystemdConnection()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	properties := []systemdDbus.Property{
+		{Name: "PIDs", Value: dbus.MakeVariant([]uint32{pid})},
+		{Name: "Delegate", Value: dbus.MakeVariant(true)},
+	}
+
+	resultCh := make(chan string, 1)
+	if _, err := conn.StartTransientUnit(unitName, "replace", properties, resultCh); err != nil {
+		return err
+	}
+
+	select {
+	case result := <-resultCh:
+		if result != "done" {
+			return fmt.Errorf("starting transient scope %s returned %q", unitName, result)
+		}
+	case <-time.After(10 * time.Second):
+		return fmt.Errorf("timed out waiting for transient scope %s to start", unitName)
+	}
+
+	return nil
+}
+
+// StreamCheckpoint tars up a checkpoint directory onto w, so it can be piped
+// to another node's driver (over the Nomad RPC stream, scp, etc.) for live
+// migration.
+func StreamCheckpoint(checkpointDir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	return filepath.Walk(checkpointDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(checkpointDir, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// ReceiveCheckpoint is the receiving end of StreamCheckpoint: it unpacks the
+// tar stream into destDir so Restore can be run against it on the target
+// node.
+func ReceiveCheckpoint(r io.Reader, destDir string) error {
+	if err := os.MkdirAll(destDir, 0700); err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destDir, hdr.Name)
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode))
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		f.Close()
+	}
+}
+
+// resumeAfterRestore puts a just-restored handle back into the normal
+// running state and starts waiting on the CRIU-restored leader pid. Unlike
+// a freshly launched task, h.exec still wraps the pre-checkpoint process (a
+// non-"--leave-running" dump has already killed it), so it can't be used to
+// wait for this one - runRestored polls the restored pid directly instead
+// of going through h.run()/h.exec.Wait().
+func (h *taskHandle) resumeAfterRestore(pid uint32) {
+	h.stateLock.Lock()
+	h.procState = drivers.TaskStateRunning
+	h.startedAt = time.Now()
+	h.stateLock.Unlock()
+
+	go h.runRestored(pid)
+}
+
+// restorePollInterval is how often runRestored checks whether the restored
+// leader pid is still alive.
+const restorePollInterval = time.Second
+
+// runRestored waits for the CRIU-restored leader process to exit by polling
+// /proc/<pid>, then updates state and tears down the task the same way
+// run() does. pid was re-parented to init by --restore-detached, so it's
+// not a child of this process and can't be wait4()'d: we can detect that it
+// exited, but not recover its real exit code or signal the way exec.Cmd
+// can, so ExitResult reports a synthetic success code. A pidfd-based wait
+// would let us recover the real status without polling, but pidfd_open
+// support varies across the kernels this driver targets.
+func (h *taskHandle) runRestored(pid uint32) {
+	h.stateLock.Lock()
+	if h.exitResult == nil {
+		h.exitResult = &drivers.ExitResult{}
+	}
+	h.stateLock.Unlock()
+
+	procPath := fmt.Sprintf("/proc/%d", pid)
+	for {
+		if _, err := os.Stat(procPath); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(restorePollInterval)
+	}
+
+	h.stateLock.Lock()
+	h.procState = drivers.TaskStateExited
+	h.exitResult.ExitCode = 0
+	h.completedAt = time.Now()
+	h.stateLock.Unlock()
+
+	h.logger.Debug("restored process exited", "pid", pid)
+	h.Close()
+}
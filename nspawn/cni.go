@@ -0,0 +1,248 @@
+package nspawn
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/containernetworking/cni/libcni"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/types/create"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/vishvananda/netns"
+)
+
+const (
+	// defaultCNIVersion is the CNI result version parseCNIResult normalizes
+	// plugin results to; results from plugins that only speak older versions
+	// are converted to it.
+	defaultCNIVersion = "1.0.0"
+
+	cniNetnsIfName = "eth0"
+)
+
+// CNIConfig configures a CNI network to be set up for a task before
+// systemd-nspawn is started, and torn down again when the task exits.
+type CNIConfig struct {
+	// Name is the network name to invoke, as found in one of the conflist
+	// files under ConfDir.
+	Name string `codec:"name"`
+	// ConfDir is the directory searched for the conflist, in the same spirit
+	// as NETCONFPATH. It names a single directory; a list of paths is not
+	// split or searched in turn. Defaults to /etc/cni/net.d when empty.
+	ConfDir string `codec:"conf_dir"`
+	// BinDirs are searched for the CNI plugin binaries themselves.
+	BinDirs []string `codec:"bin_dirs"`
+	// Args are passed to the plugin chain as CNI_ARGS.
+	Args MapStrStr `codec:"args"`
+	// CapabilityArgs are passed as the "runtimeConfig" capability args, e.g.
+	// ip ranges for the host-local IPAM plugin or port mappings for portmap.
+	CapabilityArgs map[string]interface{} `codec:"capability_args"`
+}
+
+// CNIResult is the cached outcome of bringing a task's CNI network up. It is
+// kept on the taskHandle so TaskStatus can surface it and so TeardownCNINetwork
+// can tear down exactly what AddNetwork created.
+type CNIResult struct {
+	NetNSPath  string
+	IPs        []string
+	Routes     []string
+	DNS        []string
+	RuntimeCfg *libcni.RuntimeConf
+}
+
+// SetupCNINetwork creates a fresh network namespace, runs the configured CNI
+// plugin chain against it and returns the parsed result. The caller is
+// expected to pass the returned NetNSPath to nspawn via
+// --network-namespace-path.
+func SetupCNINetwork(taskID string, cfg *CNIConfig, logger hclog.Logger) (*CNIResult, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("cni.name is required")
+	}
+
+	confDir := cfg.ConfDir
+	if confDir == "" {
+		confDir = "/etc/cni/net.d"
+	}
+
+	netConfList, err := libcni.LoadConfList(confDir, cfg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cni conflist %q from %s: %v", cfg.Name, confDir, err)
+	}
+
+	ns, err := newPersistentNetNS(taskID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create network namespace: %v", err)
+	}
+
+	runtimeCfg := &libcni.RuntimeConf{
+		ContainerID:    taskID,
+		NetNS:          ns,
+		IfName:         cniNetnsIfName,
+		Args:           argsToCNIArgs(cfg.Args),
+		CapabilityArgs: cfg.CapabilityArgs,
+	}
+
+	cniConfig := libcni.NewCNIConfig(cfg.BinDirs, nil)
+
+	logger.Info("adding cni network", "network", cfg.Name, "netns", ns)
+	res, err := cniConfig.AddNetworkList(context.Background(), netConfList, runtimeCfg)
+	if err != nil {
+		_ = destroyNetNS(ns)
+		return nil, fmt.Errorf("failed to add cni network %q: %v", cfg.Name, err)
+	}
+
+	result, err := parseCNIResult(res)
+	if err != nil {
+		_ = cniConfig.DelNetworkList(context.Background(), netConfList, runtimeCfg)
+		_ = destroyNetNS(ns)
+		return nil, err
+	}
+	result.NetNSPath = ns
+	result.RuntimeCfg = runtimeCfg
+
+	return result, nil
+}
+
+// TeardownCNINetwork runs the CNI DEL chain against the network created by
+// SetupCNINetwork and removes the namespace it lived in.
+func TeardownCNINetwork(cfg *CNIConfig, result *CNIResult, logger hclog.Logger) error {
+	if cfg == nil || result == nil {
+		return nil
+	}
+
+	confDir := cfg.ConfDir
+	if confDir == "" {
+		confDir = "/etc/cni/net.d"
+	}
+
+	netConfList, err := libcni.LoadConfList(confDir, cfg.Name)
+	if err != nil {
+		return fmt.Errorf("failed to load cni conflist %q from %s: %v", cfg.Name, confDir, err)
+	}
+
+	cniConfig := libcni.NewCNIConfig(cfg.BinDirs, nil)
+
+	logger.Info("removing cni network", "network", cfg.Name, "netns", result.NetNSPath)
+	if err := cniConfig.DelNetworkList(context.Background(), netConfList, result.RuntimeCfg); err != nil {
+		return fmt.Errorf("failed to delete cni network %q: %v", cfg.Name, err)
+	}
+
+	return destroyNetNS(result.NetNSPath)
+}
+
+// parseCNIResult normalizes whatever CNI version the plugin chain returned
+// into the 1.0.0 result shape, falling back to the types/create factory for
+// plugins that only understand 0.4.0/0.3.1.
+func parseCNIResult(res cnitypes.Result) (*CNIResult, error) {
+	r, err := current.NewResultFromResult(res)
+	if err != nil {
+		converted, cerr := create.CreateFromVersion(res, defaultCNIVersion)
+		if cerr != nil {
+			return nil, fmt.Errorf("failed to parse cni result: %v", err)
+		}
+		r, err = current.NewResultFromResult(converted)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert cni result to 1.0.0: %v", err)
+		}
+	}
+
+	out := &CNIResult{}
+	for _, ip := range r.IPs {
+		out.IPs = append(out.IPs, ip.Address.String())
+	}
+	for _, route := range r.Routes {
+		out.Routes = append(out.Routes, route.Dst.String())
+	}
+	if r.DNS.Nameservers != nil {
+		out.DNS = append(out.DNS, r.DNS.Nameservers...)
+	}
+	return out, nil
+}
+
+func argsToCNIArgs(m MapStrStr) [][2]string {
+	if len(m) == 0 {
+		return nil
+	}
+	args := make([][2]string, 0, len(m))
+	for k, v := range m {
+		args = append(args, [2]string{k, v})
+	}
+	return args
+}
+
+// netNSRunDir is the well-known bind-mount directory netns.NewNamed creates
+// named handles under (the same convention "ip netns" and every other CNI
+// runtime uses).
+const netNSRunDir = "/var/run/netns"
+
+// newPersistentNetNS creates a bind-mounted network namespace under
+// /var/run/netns so it can be handed to systemd-nspawn by path and outlives
+// the goroutine that created it. netns.NewNamed does the mkdir/bind-mount
+// itself and fails if the target already exists, so we don't pre-create
+// anything ourselves - we just confirm the handle it created and hand back
+// its path.
+//
+// netns.NewNamed performs setns/unshare on the calling OS thread, not just
+// some logical handle, so it runs in its own goroutine locked to its OS
+// thread for the duration: the thread is only unlocked once it has been
+// switched back to the original namespace, so it's safe for the Go runtime
+// to hand that thread to unrelated goroutines again afterwards. On any
+// error the goroutine exits with the thread still locked, and the runtime
+// discards the thread instead of reusing it. The caller's own goroutine
+// never risks running a dbus call inside the wrong netns.
+func newPersistentNetNS(taskID string) (string, error) {
+	name := "nspawn-" + taskID
+
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		orig, err := netns.Get()
+		if err != nil {
+			errCh <- fmt.Errorf("failed to save current netns: %v", err)
+			return
+		}
+		defer orig.Close()
+
+		handle, err := netns.NewNamed(name)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		handle.Close()
+
+		if err := netns.Set(orig); err != nil {
+			errCh <- fmt.Errorf("failed to restore original netns on creating thread: %v", err)
+			return
+		}
+		runtime.UnlockOSThread()
+		errCh <- nil
+	}()
+	if err := <-errCh; err != nil {
+		return "", err
+	}
+
+	nsPath := filepath.Join(netNSRunDir, name)
+	verify, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		return "", fmt.Errorf("namespace bind-mounted by NewNamed not found at %s: %v", nsPath, err)
+	}
+	verify.Close()
+
+	return nsPath, nil
+}
+
+func destroyNetNS(nsPath string) error {
+	if nsPath == "" {
+		return nil
+	}
+	name := filepath.Base(nsPath)
+	if err := netns.DeleteNamed(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
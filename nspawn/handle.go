@@ -2,6 +2,8 @@ package nspawn
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,6 +24,38 @@ const (
 // machinePropertiesTimeout = 30 * time.Second
 )
 
+// handleRegistry tracks the live taskHandle for each task ID so code that
+// doesn't otherwise have a reference to it - in particular the auto-update
+// reconciler, which watches a task across the restart that replaces its
+// taskHandle - can look up whichever handle is currently current.
+var (
+	handleRegistryMu sync.Mutex
+	handleRegistry   = map[string]*taskHandle{}
+)
+
+func registerTaskHandle(id string, h *taskHandle) {
+	handleRegistryMu.Lock()
+	defer handleRegistryMu.Unlock()
+	handleRegistry[id] = h
+}
+
+// unregisterTaskHandle removes h from the registry, but only if it's still
+// the handle registered for id - a later restart may already have
+// registered a new one for the same task ID.
+func unregisterTaskHandle(id string, h *taskHandle) {
+	handleRegistryMu.Lock()
+	defer handleRegistryMu.Unlock()
+	if handleRegistry[id] == h {
+		delete(handleRegistry, id)
+	}
+}
+
+func lookupTaskHandle(id string) *taskHandle {
+	handleRegistryMu.Lock()
+	defer handleRegistryMu.Unlock()
+	return handleRegistry[id]
+}
+
 type taskHandle struct {
 	machineName string
 	logger      hclog.Logger
@@ -29,13 +63,63 @@ type taskHandle struct {
 	// stateLock syncs access to all fields below
 	stateLock sync.RWMutex
 
-	exec         executor.Executor
-	pluginClient *plugin.Client
-	taskConfig   *drivers.TaskConfig
-	procState    drivers.TaskState
-	startedAt    time.Time
-	completedAt  time.Time
-	exitResult   *drivers.ExitResult
+	exec          executor.Executor
+	pluginClient  *plugin.Client
+	taskConfig    *drivers.TaskConfig
+	machineConfig *MachineConfig
+	procState     drivers.TaskState
+	startedAt     time.Time
+	completedAt   time.Time
+	exitResult    *drivers.ExitResult
+
+	// cniResult caches the outcome of the CNI plugin chain, when the task's
+	// MachineConfig sets a CNI block, so TaskStatus can surface the assigned
+	// IPs/routes/DNS and Stop/Destroy can release IPAM state.
+	cniConfig *CNIConfig
+	cniResult *CNIResult
+
+	// autoUpdate runs the background reconciler when MachineConfig.AutoUpdate
+	// is set; nil otherwise.
+	autoUpdate *autoUpdater
+}
+
+// newTaskHandle builds the taskHandle for a task that's about to be
+// launched, standing up anything that has to exist before the
+// systemd-nspawn invocation itself does. In particular, when mc.CNI is set
+// it creates the netns and runs the CNI plugin chain, then points
+// mc.cniNetnsPath at it so ConfigArray() passes it to nspawn via
+// --network-namespace-path. Callers (StartTask) still call exec.Launch
+// themselves using mc.ConfigArray() afterwards.
+func newTaskHandle(cfg *drivers.TaskConfig, mc *MachineConfig, machineName string, logger hclog.Logger) (*taskHandle, error) {
+	h := &taskHandle{
+		machineName:   machineName,
+		logger:        logger,
+		taskConfig:    cfg,
+		machineConfig: mc,
+		procState:     drivers.TaskStateRunning,
+		cniConfig:     mc.CNI,
+	}
+
+	if mc.CNI != nil {
+		result, err := SetupCNINetwork(cfg.ID, mc.CNI, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up cni network: %v", err)
+		}
+		mc.cniNetnsPath = result.NetNSPath
+		h.cniResult = result
+	}
+
+	if mc.AutoUpdate != nil {
+		startDigest, err := ResolveImageDigest(mc.ImageDownloadRef(), mc.Machine, mc.AutoUpdate.Policy, mc.imageDownloadAuth())
+		if err != nil {
+			logger.Warn("failed to resolve starting image digest, auto-update will treat the first reconcile as an update", "error", err)
+		}
+		h.autoUpdate = startAutoUpdate(h, mc, startDigest)
+	}
+
+	registerTaskHandle(cfg.ID, h)
+
+	return h, nil
 }
 
 /*func (h *taskHandle) DescribeMachine() (*MachineProps, error) {
@@ -53,7 +137,7 @@ func (h *taskHandle) TaskStatus() *drivers.TaskStatus {
 	h.stateLock.RLock()
 	defer h.stateLock.RUnlock()
 
-	return &drivers.TaskStatus{
+	status := &drivers.TaskStatus{
 		ID:          h.taskConfig.ID,
 		Name:        h.taskConfig.Name,
 		State:       h.procState,
@@ -65,6 +149,27 @@ func (h *taskHandle) TaskStatus() *drivers.TaskStatus {
 		//	"pid": strconv.FormatUint(uint64(h.machine.Leader), 10),
 		// },
 	}
+
+	if h.cniResult != nil {
+		status.DriverAttributes = map[string]string{
+			"cni.netns":  h.cniResult.NetNSPath,
+			"cni.ips":    strings.Join(h.cniResult.IPs, ","),
+			"cni.routes": strings.Join(h.cniResult.Routes, ","),
+			"cni.dns":    strings.Join(h.cniResult.DNS, ","),
+		}
+	}
+
+	if attrs := h.autoUpdate.driverAttributes(); attrs != nil {
+		if status.DriverAttributes == nil {
+			status.DriverAttributes = attrs
+		} else {
+			for k, v := range attrs {
+				status.DriverAttributes[k] = v
+			}
+		}
+	}
+
+	return status
 }
 
 func (h *taskHandle) IsRunning() bool {
@@ -73,6 +178,45 @@ func (h *taskHandle) IsRunning() bool {
 	return h.procState == drivers.TaskStateRunning
 }
 
+// cleanupCNI tears down the network set up for this task, if any. It is a
+// no-op for tasks that didn't configure a cni block.
+func (h *taskHandle) cleanupCNI() error {
+	h.stateLock.RLock()
+	cfg, result := h.cniConfig, h.cniResult
+	h.stateLock.RUnlock()
+
+	if cfg == nil || result == nil {
+		return nil
+	}
+	return TeardownCNINetwork(cfg, result, h.logger)
+}
+
+// stopAutoUpdate halts the background reconciler, if one was started for
+// this task. Safe to call even when auto_update wasn't configured.
+func (h *taskHandle) stopAutoUpdate() {
+	h.stateLock.RLock()
+	u := h.autoUpdate
+	h.stateLock.RUnlock()
+
+	if u != nil {
+		u.stop()
+	}
+}
+
+// Close tears down everything newTaskHandle stood up that doesn't go away
+// on its own once the machine has exited: the CNI network/netns and the
+// auto-update reconciler goroutine. It's idempotent and safe to call
+// whenever the task is considered gone for good (process exit, Stop,
+// Destroy), and unregisters h so later auto-update lookups for this task ID
+// stop resolving to a dead handle.
+func (h *taskHandle) Close() {
+	h.stopAutoUpdate()
+	if err := h.cleanupCNI(); err != nil {
+		h.logger.Error("failed to tear down cni network", "error", err)
+	}
+	unregisterTaskHandle(h.taskConfig.ID, h)
+}
+
 func (h *taskHandle) run() {
 	h.stateLock.Lock()
 	if h.exitResult == nil {
@@ -82,17 +226,20 @@ func (h *taskHandle) run() {
 
 	ps, err := h.exec.Wait(context.Background())
 	h.stateLock.Lock()
-	defer h.stateLock.Unlock()
 
 	if err != nil {
 		h.exitResult.Err = err
 		h.procState = drivers.TaskStateUnknown
 		h.completedAt = time.Now()
+		h.stateLock.Unlock()
+		h.Close()
 		return
 	}
 	h.procState = drivers.TaskStateExited
 	h.exitResult.ExitCode = ps.ExitCode
 	h.exitResult.Signal = ps.Signal
 	h.completedAt = ps.Time
+	h.stateLock.Unlock()
 	h.logger.Debug("run() exited successful")
+	h.Close()
 }
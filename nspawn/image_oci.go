@@ -0,0 +1,332 @@
+package nspawn
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker"
+	dockerConfig "github.com/containers/image/v5/pkg/docker/config"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	hclog "github.com/hashicorp/go-hclog"
+	digest "github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	OCIImage    string = "oci"
+	DockerImage string = "docker"
+
+	machinesDir = "/var/lib/machines"
+)
+
+// RegistryAuth configures credentials for an OCI/Docker registry pull. When
+// empty, the ambient docker config JSON (as picked up by
+// containers/image/pkg/docker/config) is used instead.
+type RegistryAuth struct {
+	Username string `codec:"username"`
+	Password string `codec:"password"`
+}
+
+// SignatureKey names the key material used to verify a signed image when
+// ImageDownloadOpts.Verify is "signature". KeyType is "gpg" (the default)
+// for a GPG keyring or "x509" for X.509 certificates at PublicKeyPath;
+// cosign and notation keys are not accepted.
+type SignatureKey struct {
+	KeyType       string `codec:"key_type"`
+	PublicKeyPath string `codec:"public_key_path"`
+}
+
+// PullOCIImage resolves a docker://, oci:// or oci-archive:// reference,
+// picks the right platform out of a manifest list/OCI index, pulls and
+// verifies the layers and unpacks the resulting rootfs into
+// /var/lib/machines/<name> so machinectl can treat it as a plain directory
+// image. It returns the resulting image path and the resolved manifest
+// digest.
+// cache may be nil, in which case every pull hits the registry directly.
+// sigKey is required when verify is "signature" and ignored otherwise.
+func PullOCIImage(ref, name string, auth *RegistryAuth, verify string, sigKey *SignatureKey, force bool, cache *BlobCache, logger hclog.Logger) (string, string, error) {
+	destDir := filepath.Join(machinesDir, name)
+
+	if !force {
+		if _, err := os.Stat(destDir); err == nil {
+			return destDir, "", fmt.Errorf("image %q already exists, set force to re-pull", name)
+		}
+	}
+
+	blobDir, err := os.MkdirTemp("", "nspawn-oci-pull-")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(blobDir)
+
+	srcRef, err := resolveSourceReference(ref)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to resolve image reference %q: %v", ref, err)
+	}
+
+	destRef, err := alltransports.ParseImageName("dir:" + blobDir)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to construct destination reference: %v", err)
+	}
+
+	if cache != nil {
+		srcRef = cachedImageReference{ImageReference: srcRef, cache: cache}
+	}
+
+	sysCtx := &types.SystemContext{}
+	if auth != nil && auth.Username != "" {
+		sysCtx.DockerAuthConfig = &types.DockerAuthConfig{
+			Username: auth.Username,
+			Password: auth.Password,
+		}
+	} else if creds, err := dockerConfig.GetCredentials(sysCtx, refHostname(ref)); err == nil && creds.Username != "" {
+		sysCtx.DockerAuthConfig = &types.DockerAuthConfig{
+			Username: creds.Username,
+			Password: creds.Password,
+		}
+	}
+
+	policy, err := signaturePolicy(verify, sigKey)
+	if err != nil {
+		return "", "", err
+	}
+	policyCtx, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to build signature policy context: %v", err)
+	}
+	defer policyCtx.Destroy()
+
+	logger.Info("pulling oci image", "ref", ref, "dest", destDir)
+	manifestBytes, err := copy.Image(context.Background(), policyCtx, destRef, srcRef, &copy.Options{
+		SourceCtx:    sysCtx,
+		ReportWriter: hclogWriter{logger},
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to copy image %q: %v", ref, err)
+	}
+
+	imgDigest := digest.FromBytes(manifestBytes).String()
+
+	// A forced re-pull must replace the rootfs wholesale: unpacking the new
+	// layers on top of whatever is already there would merge the two images
+	// instead of reproducing the new one (renamed/removed files would never
+	// go away).
+	if err := os.RemoveAll(destDir); err != nil {
+		return "", "", err
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return "", "", err
+	}
+	if err := unpackManifestLayers(blobDir, manifestBytes, destDir); err != nil {
+		os.RemoveAll(destDir)
+		return "", "", fmt.Errorf("failed to unpack image rootfs: %v", err)
+	}
+
+	logger.Info("pulled oci image", "ref", ref, "digest", imgDigest)
+	return destDir, imgDigest, nil
+}
+
+// resolveSourceReference turns a "docker://..." or bare "name:tag" reference
+// (as used by ImageDownloadOpts.URL) into a containers/image ImageReference,
+// defaulting to the docker transport the way docker-cli does.
+func resolveSourceReference(ref string) (types.ImageReference, error) {
+	if strings.Contains(ref, "://") {
+		return alltransports.ParseImageName(ref)
+	}
+	return docker.ParseReference("//" + ref)
+}
+
+func refHostname(ref string) string {
+	trimmed := strings.TrimPrefix(ref, "docker://")
+	if i := strings.IndexByte(trimmed, '/'); i >= 0 {
+		return trimmed[:i]
+	}
+	return trimmed
+}
+
+// signaturePolicy maps ImageDownloadOpts.Verify onto a containers/image
+// signature policy: "no"/"checksum" accept anything beyond the digest
+// pinning copy.Image already does, "signature" requires a cryptographic
+// signature verified against sigKey's key material.
+func signaturePolicy(verify string, sigKey *SignatureKey) (*signature.Policy, error) {
+	if verify != "signature" {
+		return &signature.Policy{
+			Default: signature.PolicyRequirements{signature.NewPRInsecureAcceptAnything()},
+		}, nil
+	}
+
+	if sigKey == nil || sigKey.PublicKeyPath == "" {
+		return nil, fmt.Errorf("image_download.verify=signature requires a signature_key.public_key_path")
+	}
+
+	var keyType signature.SBKeyType
+	switch sigKey.KeyType {
+	case "", "gpg":
+		keyType = signature.SBKeyTypeGPGKeys
+	case "x509":
+		keyType = signature.SBKeyTypeX509Certificates
+	default:
+		return nil, fmt.Errorf("invalid signature_key.key_type %q", sigKey.KeyType)
+	}
+
+	req, err := signature.NewPRSignedByKeyPath(keyType, sigKey.PublicKeyPath, signature.NewPRMMatchRepoDigestOrExact())
+	if err != nil {
+		return nil, fmt.Errorf("failed to build signature requirement: %v", err)
+	}
+
+	return &signature.Policy{
+		Default: signature.PolicyRequirements{req},
+	}, nil
+}
+
+// unpackManifestLayers reads the OCI manifest written into blobDir by the
+// "dir:" transport and extracts each gzip+tar layer on top of destDir in
+// order, the same flattening machinectl expects of a directory image.
+func unpackManifestLayers(blobDir string, manifestBytes []byte, destDir string) error {
+	var manifest ociv1.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return fmt.Errorf("failed to parse manifest: %v", err)
+	}
+
+	for _, layer := range manifest.Layers {
+		blobPath := filepath.Join(blobDir, strings.TrimPrefix(layer.Digest.String(), "sha256:"))
+		if err := extractLayer(blobPath, destDir); err != nil {
+			return fmt.Errorf("failed to extract layer %s: %v", layer.Digest, err)
+		}
+	}
+	return nil
+}
+
+func extractLayer(blobPath, destDir string) error {
+	f, err := os.Open(blobPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		base := filepath.Base(hdr.Name)
+		if strings.HasPrefix(base, ".wh.") {
+			if err := applyWhiteout(destDir, hdr.Name, base); err != nil {
+				return err
+			}
+			continue
+		}
+
+		target, err := safeJoin(destDir, hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			out.Close()
+		case tar.TypeSymlink:
+			linkPath := hdr.Linkname
+			if !filepath.IsAbs(linkPath) {
+				linkPath = filepath.Join(filepath.Dir(hdr.Name), linkPath)
+			}
+			if _, err := safeJoin(destDir, linkPath); err != nil {
+				return fmt.Errorf("symlink target %q escapes image root: %v", hdr.Linkname, err)
+			}
+			os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// safeJoin joins name onto dir the way filepath.Join would, but rejects any
+// result that escapes dir after cleaning - guarding against tar-slip path
+// traversal from a malicious or buggy layer (e.g. "../../etc/cron.d/x").
+func safeJoin(dir, name string) (string, error) {
+	target := filepath.Join(dir, name)
+	if target != dir && !strings.HasPrefix(target, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q escapes image root %q", name, dir)
+	}
+	return target, nil
+}
+
+// applyWhiteout implements the OCI image-spec whiteout convention: a
+// ".wh.<name>" entry removes <name> from the lower layers, and the special
+// ".wh..wh..opq" entry makes the containing directory opaque (removes
+// everything already unpacked under it) before the upper layer's own
+// entries for that directory are applied.
+func applyWhiteout(destDir, hdrName, base string) error {
+	dir, err := safeJoin(destDir, filepath.Dir(hdrName))
+	if err != nil {
+		return err
+	}
+
+	if base == ".wh..wh..opq" {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		for _, e := range entries {
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	removed := filepath.Join(dir, strings.TrimPrefix(base, ".wh."))
+	if err := os.RemoveAll(removed); err != nil {
+		return err
+	}
+	return nil
+}
+
+type hclogWriter struct {
+	logger hclog.Logger
+}
+
+func (w hclogWriter) Write(p []byte) (int, error) {
+	w.logger.Debug(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
@@ -29,6 +29,10 @@ const (
 	RawImage string = "raw"
 )
 
+// OCIImage and DockerImage (the "oci"/"docker" ImageDownloadOpts.Type
+// values) are declared in image_oci.go alongside the puller that handles
+// them.
+
 type MachineProps struct {
 	Name               string
 	TimestampMonotonic uint64
@@ -60,6 +64,7 @@ type MachineConfig struct {
 	Image                string             `codec:"image"`
 	ImageDownload        *ImageDownloadOpts `codec:"image_download,omitempty"`
 	imagePath            string             `codec:"-"`
+	cniNetnsPath         string             `codec:"-"`
 	Machine              string             `codec:"machine"`
 	PivotRoot            string             `codec:"pivot_root"`
 	ResolvConf           string             `codec:"resolv_conf"`
@@ -67,6 +72,8 @@ type MachineConfig struct {
 	Volatile             string             `codec:"volatile"`
 	WorkingDirectory     string             `codec:"working_directory"`
 	NetworkNamespacePath string             `codec:"network_namespace_path"`
+	CNI                  *CNIConfig         `codec:"cni,omitempty"`
+	AutoUpdate           *AutoUpdateConfig  `codec:"auto_update,omitempty"`
 	Bind                 MapStrStr          `codec:"bind"`
 	BindReadOnly         MapStrStr          `codec:"bind_read_only"`
 	Environment          MapStrStr          `codec:"environment"`
@@ -89,10 +96,12 @@ type ImageProps struct {
 }
 
 type ImageDownloadOpts struct {
-	URL    string `codec:"url"`
-	Type   string `codec:"type"`
-	Force  bool   `codec:"force"`
-	Verify string `codec:"verify"`
+	URL          string        `codec:"url"`
+	Type         string        `codec:"type"`
+	Force        bool          `codec:"force"`
+	Verify       string        `codec:"verify"`
+	Auth         *RegistryAuth `codec:"auth,omitempty"`
+	SignatureKey *SignatureKey `codec:"signature_key,omitempty"`
 }
 
 func (c *MachineConfig) ConfigArray() ([]string, error) {
@@ -149,6 +158,9 @@ func (c *MachineConfig) ConfigArray() ([]string, error) {
 	if c.NetworkNamespacePath != "" {
 		args = append(args, "--network-namespace-path", c.NetworkNamespacePath)
 	}
+	if c.cniNetnsPath != "" {
+		args = append(args, "--network-namespace-path", c.cniNetnsPath)
+	}
 	for k, v := range c.Bind {
 		args = append(args, "--bind", k+":"+v)
 	}
@@ -215,7 +227,7 @@ func (c *MachineConfig) Validate() error {
 
 	if c.ImageDownload != nil {
 		switch c.ImageDownload.Type {
-		case "raw", "tar":
+		case "raw", "tar", OCIImage, DockerImage:
 		default:
 			return fmt.Errorf("invalid parameter for image_download.type")
 		}
@@ -224,6 +236,24 @@ func (c *MachineConfig) Validate() error {
 		default:
 			return fmt.Errorf("invalid parameter for image_download.verify")
 		}
+		if c.ImageDownload.Verify == "signature" && (c.ImageDownload.SignatureKey == nil || c.ImageDownload.SignatureKey.PublicKeyPath == "") {
+			return fmt.Errorf("image_download.signature_key.public_key_path is required when verify is signature")
+		}
+	}
+
+	if c.CNI != nil {
+		if c.NetworkNamespacePath != "" {
+			return fmt.Errorf("cni and network_namespace_path may not be combined")
+		}
+		if c.CNI.Name == "" {
+			return fmt.Errorf("cni.name is required")
+		}
+	}
+
+	if c.AutoUpdate != nil {
+		if err := c.AutoUpdate.Validate(); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -402,7 +432,16 @@ func DescribeImage(name string) (*ImageProps, error) {
 	}, nil
 }
 
-func DownloadImage(url, name, verify, imageType string, force bool, logger hclog.Logger) error {
+func DownloadImage(url, name, verify, imageType string, force bool, auth *RegistryAuth, sigKey *SignatureKey, cache *BlobCache, logger hclog.Logger) error {
+	if imageType == OCIImage || imageType == DockerImage {
+		_, digest, err := PullOCIImage(url, name, auth, verify, sigKey, force, cache, logger)
+		if err != nil {
+			return err
+		}
+		logger.Info("downloaded image", "image", name, "digest", digest)
+		return nil
+	}
+
 	c, err := import1.New()
 	if err != nil {
 		return err
@@ -453,6 +492,23 @@ func DownloadImage(url, name, verify, imageType string, force bool, logger hclog
 	return nil
 }
 
+// ImageDownloadRef returns the source reference auto-update should
+// re-resolve against, i.e. whatever ImageDownload.URL the task was
+// originally pulled from.
+func (c *MachineConfig) ImageDownloadRef() string {
+	if c.ImageDownload == nil {
+		return ""
+	}
+	return c.ImageDownload.URL
+}
+
+func (c *MachineConfig) imageDownloadAuth() *RegistryAuth {
+	if c.ImageDownload == nil {
+		return nil
+	}
+	return c.ImageDownload.Auth
+}
+
 func (c *MachineConfig) GetImagePath() (string, error) {
 	// check if image is absolute or relative path
 	imagePath := c.Image